@@ -0,0 +1,55 @@
+// Package apierror implements RFC 7807 (application/problem+json) error responses.
+package apierror
+
+import (
+	"github.com/go-playground/validator"
+)
+
+// ContentType is the media type problem responses are served with, per RFC 7807
+const ContentType = "application/problem+json"
+
+// FieldViolation describes a single field that failed validation
+type FieldViolation struct {
+	Field  string `json:"field"`
+	Tag    string `json:"tag"`
+	Detail string `json:"detail"`
+}
+
+// Problem is an RFC 7807 problem detail, extended with a violations list for validation errors
+type Problem struct {
+	Type       string           `json:"type"`
+	Title      string           `json:"title"`
+	Status     int              `json:"status"`
+	Detail     string           `json:"detail,omitempty"`
+	Instance   string           `json:"instance,omitempty"`
+	Violations []FieldViolation `json:"violations,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return p.Title
+}
+
+// New builds a Problem with the given type URI, human-readable title, status and detail
+func New(problemType, title string, status int, detail, instance string) *Problem {
+	return &Problem{
+		Type:     problemType,
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: instance,
+	}
+}
+
+// FromValidationErrors turns go-playground/validator errors into a machine-readable Problem
+// whose violations list gives the failing field and tag (e.g. "yyyy-mm-ddThh:mm:ss") for each
+func FromValidationErrors(verrs validator.ValidationErrors, status int, instance string) *Problem {
+	p := New("about:blank#validation-error", "Validation failed", status, "one or more fields failed validation", instance)
+	for _, fe := range verrs {
+		p.Violations = append(p.Violations, FieldViolation{
+			Field:  fe.Field(),
+			Tag:    fe.Tag(),
+			Detail: fe.Error(),
+		})
+	}
+	return p
+}
@@ -0,0 +1,113 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// pinger is implemented by stores that can check their own connectivity; handleReadyz uses
+// it opportunistically so readiness doesn't require every store.Store implementation to support it
+type pinger interface {
+	Ping() error
+}
+
+// upstreamHealthChecker is implemented opportunistically by a config that knows of an upstream
+// dependency readyz should verify via s.client; configs that don't implement it skip the check
+type upstreamHealthChecker interface {
+	UpstreamHealthURL() string
+}
+
+// checkUpstream HEADs the configured upstream health URL through s.client, if any is configured
+func (s *server) checkUpstream(ctx context.Context) error {
+	checker, ok := interface{}(s.config).(upstreamHealthChecker)
+	if !ok {
+		return nil
+	}
+	url := checker.UpstreamHealthURL()
+	if url == "" {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Start runs the HTTP server on addr until ctx is cancelled, then shuts it down gracefully
+func (s *server) Start(ctx context.Context, addr string) error {
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.httpServer.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return s.Shutdown(context.Background())
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+// Shutdown waits for in-flight requests to finish, then closes the store and the HTTP client
+func (s *server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	s.client.CloseIdleConnections()
+
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// handleHealthz is a liveness probe: if the process can answer, it's alive
+func (s *server) handleHealthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.respond(w, r, http.StatusOK, newResponse("ok", "alive"))
+	}
+}
+
+// handleReadyz is a readiness probe: it additionally pings the store when the store supports
+// it, and checks any upstream dependency reachable through s.client when the config knows of one
+func (s *server) handleReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := s.store.(pinger); ok {
+			if err := p.Ping(); err != nil {
+				s.error(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+		}
+		if err := s.checkUpstream(r.Context()); err != nil {
+			s.error(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		s.respond(w, r, http.StatusOK, newResponse("ok", "ready"))
+	}
+}
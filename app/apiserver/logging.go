@@ -0,0 +1,100 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type loggerCtxKey struct{}
+
+type errCtxKey struct{}
+
+// errHolder lets s.error report the error it was given back to requestLogging's summary line,
+// since the two run in different stack frames connected only by the request context
+type errHolder struct {
+	err error
+}
+
+// newSlogLogger builds the package's structured logger: JSON by default, or plain text
+// when textFormat is set from config (e.g. for local development)
+func newSlogLogger(textFormat bool) *slog.Logger {
+	var handler slog.Handler
+	if textFormat {
+		handler = slog.NewTextHandler(os.Stdout, nil)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, nil)
+	}
+	return slog.New(handler)
+}
+
+// loggerFromContext returns the request-scoped logger attached by requestLogging,
+// falling back to the server's base logger if the request was never wrapped (e.g. in tests)
+func (s *server) loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return s.logger
+}
+
+// withUserID returns a context whose logger is annotated with the authenticated user_id
+func withUserID(ctx context.Context, l *slog.Logger, userID uint64) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, l.With("user_id", userID))
+}
+
+// newRequestID returns a short random hex correlation id
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder captures the status code written by a handler so it can be logged afterwards
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// requestLogging generates or propagates an X-Request-ID, attaches a request-scoped logger
+// to the request context, and emits one structured log line per request on completion
+func (s *server) requestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+
+		reqLogger := s.logger.With("request_id", requestID)
+		holder := &errHolder{}
+		ctx := context.WithValue(r.Context(), loggerCtxKey{}, reqLogger)
+		ctx = context.WithValue(ctx, errCtxKey{}, holder)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		fields := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_ip", r.RemoteAddr,
+		}
+		if holder.err != nil {
+			fields = append(fields, "error", holder.err.Error())
+		}
+		s.loggerFromContext(ctx).Info("handled request", fields...)
+	})
+}
@@ -0,0 +1,70 @@
+package apiserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total HTTP requests handled, partitioned by route, method and status",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, partitioned by route, method and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	authTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_attempts_total",
+		Help: "Authentication attempts, partitioned by outcome",
+	}, []string{"outcome"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Database call latency, partitioned by query",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+// metrics wraps every routed request with request counters and a latency histogram,
+// labeled by the route's path template rather than the raw path to keep cardinality bounded
+func (s *server) metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if rt := mux.CurrentRoute(r); rt != nil {
+			if tmpl, err := rt.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		status := strconv.Itoa(rec.status)
+
+		httpRequestsTotal.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeDBQuery times fn and records its duration under query's label
+func observeDBQuery(query string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (s *server) handleMetrics() http.Handler {
+	return promhttp.Handler()
+}
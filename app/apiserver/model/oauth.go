@@ -0,0 +1,90 @@
+package model
+
+import "time"
+
+// ClientInfo describes a registered OAuth2 client
+type ClientInfo struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"-"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Grants       []string `json:"grants"`
+}
+
+// AllowsScope reports whether the client is permitted to request scope
+func (c ClientInfo) AllowsScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRedirectURI reports whether uri matches one of the client's registered redirect URIs
+func (c ClientInfo) AllowsRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGrant reports whether the client may use the given grant type
+func (c ClientInfo) AllowsGrant(grant string) bool {
+	for _, g := range c.Grants {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthCode is a short-lived authorization code issued during the authorization_code grant
+type AuthCode struct {
+	Code        string
+	ClientID    string
+	UserID      uint64
+	RedirectURI string
+	Scope       string
+	Exp         time.Time
+}
+
+// AccessToken is an issued OAuth2 access token
+type AccessToken struct {
+	Token    string
+	ClientID string
+	UserID   uint64
+	Scope    string
+	Exp      time.Time
+}
+
+// RefreshToken is an issued OAuth2 refresh token, chained into a rotation family
+type RefreshToken struct {
+	Token    string
+	FamilyID string
+	ClientID string
+	UserID   uint64
+	Scope    string
+	Used     bool
+	Exp      time.Time
+}
+
+// TokenResponse is the JSON body returned from /oauth/token
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// IntrospectResponse is the JSON body returned from /oauth/introspect
+type IntrospectResponse struct {
+	Active   bool   `json:"active"`
+	ClientID string `json:"client_id,omitempty"`
+	UserID   uint64 `json:"user_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+}
@@ -0,0 +1,424 @@
+package apiserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/model"
+)
+
+// oauth errors
+var (
+	errInvalidClient    = errors.New("invalid client")
+	errInvalidGrant     = errors.New("invalid grant")
+	errInvalidScope     = errors.New("invalid scope")
+	errUnsupportedGrant = errors.New("unsupported grant type")
+	errInvalidToken     = errors.New("invalid token")
+)
+
+const (
+	grantAuthorizationCode = "authorization_code"
+	grantRefreshToken      = "refresh_token"
+	grantClientCredentials = "client_credentials"
+	grantPassword          = "password"
+
+	accessTokenTTL  = 1 * time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+	authCodeTTL     = 5 * time.Minute
+
+	//scopes required from oauth2 bearer clients on the /auth subrouter's handlers
+	scopeServiceRequestsWrite = "requests:write"
+	scopeServiceOrdersWrite   = "orders:write"
+	scopeServiceStatusesWrite = "statuses:write"
+)
+
+// newOpaqueToken returns a random, URL-safe opaque token
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateScope reports whether every space-separated scope in requested is allowed for client
+func validateScope(client *model.ClientInfo, requested string) error {
+	for _, sc := range strings.Fields(requested) {
+		if !client.AllowsScope(sc) {
+			return errInvalidScope
+		}
+	}
+	return nil
+}
+
+// handleAuthorize implements the authorization_code grant's first leg: it issues a short-lived
+// code for the client and redirects the user-agent back to the client's redirect_uri
+func (s *server) handleAuthorize() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
+		q := r.URL.Query()
+		clientID := q.Get("client_id")
+		redirectURI := q.Get("redirect_uri")
+		scope := q.Get("scope")
+		state := q.Get("state")
+
+		client, err := s.clientStore.GetByID(clientID)
+		if err != nil {
+			s.error(w, r, http.StatusUnauthorized, errInvalidClient)
+			log.Warn("unknown oauth client", "client_id", clientID, "error", err)
+			return
+		}
+
+		if !client.AllowsRedirectURI(redirectURI) {
+			s.error(w, r, http.StatusBadRequest, errInvalidClient)
+			return
+		}
+
+		if err := validateScope(client, scope); err != nil {
+			s.error(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		user_id, err := s.store.User().ExtractTokenMetadata(r, s.config)
+		if err != nil {
+			s.error(w, r, http.StatusUnauthorized, errJwt)
+			log.Warn("token extraction failed", "error", err)
+			return
+		}
+
+		code, err := newOpaqueToken()
+		if err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := s.tokenStore.SaveAuthCode(&model.AuthCode{
+			Code:        code,
+			ClientID:    clientID,
+			UserID:      user_id.UserId,
+			RedirectURI: redirectURI,
+			Scope:       scope,
+			Exp:         time.Now().Add(authCodeTTL),
+		}); err != nil {
+			s.error(w, r, http.StatusInternalServerError, err)
+			log.Error("save auth code failed", "error", err)
+			return
+		}
+
+		dest, err := url.Parse(redirectURI)
+		if err != nil {
+			s.error(w, r, http.StatusBadRequest, errInvalidClient)
+			return
+		}
+		destQuery := dest.Query()
+		destQuery.Set("code", code)
+		if state != "" {
+			destQuery.Set("state", state)
+		}
+		dest.RawQuery = destQuery.Encode()
+
+		http.Redirect(w, r, dest.String(), http.StatusFound)
+		log.Info("authorization code issued")
+	}
+}
+
+// handleToken implements the token endpoint for all supported grant types
+func (s *server) handleToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
+
+		if err := r.ParseForm(); err != nil {
+			s.error(w, r, http.StatusBadRequest, errReg)
+			return
+		}
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			clientID = r.FormValue("client_id")
+			clientSecret = r.FormValue("client_secret")
+		}
+
+		client, err := s.clientStore.GetByID(clientID)
+		if err != nil || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) != 1 {
+			s.error(w, r, http.StatusUnauthorized, errInvalidClient)
+			return
+		}
+
+		grantType := r.FormValue("grant_type")
+		if !client.AllowsGrant(grantType) {
+			s.error(w, r, http.StatusBadRequest, errUnsupportedGrant)
+			return
+		}
+
+		//the password grant re-derives end-user credentials from the request body, so it's a
+		//second login surface that needs the same brute-force protection as /authentication and /login
+		var lockoutKey string
+		if grantType == grantPassword {
+			lockoutKey = s.clientIP(r) + ":" + r.FormValue("username")
+			if locked, retryAfter, lerr := s.loginAttempts.Locked(lockoutKey); lerr == nil && locked {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+				s.error(w, r, http.StatusTooManyRequests, errTooManyAttempts)
+				log.Warn("oauth password grant blocked by lockout", "login", r.FormValue("username"))
+				return
+			}
+			if !s.limiter.Allow(lockoutKey, s.rateLimitConfig.AuthLoginRPS, s.rateLimitConfig.AuthLoginBurst) {
+				s.error(w, r, http.StatusTooManyRequests, errRateLimited)
+				return
+			}
+		}
+
+		var resp *model.TokenResponse
+		switch grantType {
+		case grantAuthorizationCode:
+			resp, err = s.exchangeAuthorizationCode(client, r)
+		case grantRefreshToken:
+			resp, err = s.exchangeRefreshToken(client, r)
+		case grantClientCredentials:
+			resp, err = s.exchangeClientCredentials(client, r)
+		case grantPassword:
+			resp, err = s.exchangePassword(client, r)
+			if errors.Is(err, errIncorrectEmailOrPassword) {
+				if locked, retryAfter, lerr := s.loginAttempts.RecordFailure(lockoutKey, maxLoginFailures, loginFailureWindow, loginLockoutDuration); lerr == nil && locked {
+					w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+				}
+			} else if err == nil {
+				if lerr := s.loginAttempts.Reset(lockoutKey); lerr != nil {
+					log.Error("login attempt reset failed", "error", lerr)
+				}
+			}
+		default:
+			err = errUnsupportedGrant
+		}
+
+		if err != nil {
+			s.error(w, r, http.StatusBadRequest, err)
+			log.Warn("oauth token grant failed", "grant_type", grantType, "error", err)
+			return
+		}
+
+		s.respond(w, r, http.StatusOK, resp)
+		log.Info("oauth token issued")
+	}
+}
+
+func (s *server) exchangeAuthorizationCode(client *model.ClientInfo, r *http.Request) (*model.TokenResponse, error) {
+	code := r.FormValue("code")
+
+	ac, err := s.tokenStore.GetAuthCode(code)
+	if err != nil {
+		return nil, errInvalidGrant
+	}
+	if ac.ClientID != client.ID || ac.RedirectURI != r.FormValue("redirect_uri") || time.Now().After(ac.Exp) {
+		return nil, errInvalidGrant
+	}
+	if err := s.tokenStore.DeleteAuthCode(code); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokenPair(client, ac.UserID, ac.Scope, true)
+}
+
+// exchangeClientCredentials issues a token for the client itself rather than an end user,
+// carrying the requested scope; if any requested scope is not allowed for the client the
+// whole request fails with errInvalidScope
+func (s *server) exchangeClientCredentials(client *model.ClientInfo, r *http.Request) (*model.TokenResponse, error) {
+	scope := r.FormValue("scope")
+	if err := validateScope(client, scope); err != nil {
+		return nil, err
+	}
+	return s.issueTokenPair(client, 0, scope, false)
+}
+
+func (s *server) exchangePassword(client *model.ClientInfo, r *http.Request) (*model.TokenResponse, error) {
+	u, err := s.store.User().FindUser(r.FormValue("username"), r.FormValue("password"))
+	if err != nil {
+		return nil, errIncorrectEmailOrPassword
+	}
+	scope := r.FormValue("scope")
+	if err := validateScope(client, scope); err != nil {
+		return nil, err
+	}
+	return s.issueTokenPair(client, uint64(u.ID), scope, true)
+}
+
+// exchangeRefreshToken rotates the refresh token on each use; reuse of an already-consumed
+// token revokes the whole token family, since it indicates the token was stolen
+func (s *server) exchangeRefreshToken(client *model.ClientInfo, r *http.Request) (*model.TokenResponse, error) {
+	raw := r.FormValue("refresh_token")
+
+	rt, err := s.tokenStore.GetRefreshToken(raw)
+	if err != nil {
+		return nil, errInvalidGrant
+	}
+	if rt.ClientID != client.ID || time.Now().After(rt.Exp) {
+		return nil, errInvalidGrant
+	}
+	if rt.Used {
+		if err := s.tokenStore.RevokeFamily(rt.FamilyID); err != nil {
+			s.loggerFromContext(r.Context()).Error("refresh token family revocation failed", "error", err)
+		}
+		return nil, errInvalidGrant
+	}
+	if err := s.tokenStore.MarkRefreshTokenUsed(raw); err != nil {
+		return nil, err
+	}
+
+	return s.issueRotatedTokenPair(client, rt.UserID, rt.Scope, rt.FamilyID)
+}
+
+func (s *server) issueTokenPair(client *model.ClientInfo, userID uint64, scope string, withRefresh bool) (*model.TokenResponse, error) {
+	familyID, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	if !withRefresh {
+		return s.issueAccessOnly(client, userID, scope)
+	}
+	return s.issueRotatedTokenPair(client, userID, scope, familyID)
+}
+
+func (s *server) issueAccessOnly(client *model.ClientInfo, userID uint64, scope string) (*model.TokenResponse, error) {
+	access, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	exp := time.Now().Add(accessTokenTTL)
+	if err := s.tokenStore.SaveAccessToken(&model.AccessToken{
+		Token: access, ClientID: client.ID, UserID: userID, Scope: scope, Exp: exp,
+	}); err != nil {
+		return nil, err
+	}
+	return &model.TokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTokenTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+func (s *server) issueRotatedTokenPair(client *model.ClientInfo, userID uint64, scope, familyID string) (*model.TokenResponse, error) {
+	resp, err := s.issueAccessOnly(client, userID, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.tokenStore.SaveRefreshToken(&model.RefreshToken{
+		Token: refresh, FamilyID: familyID, ClientID: client.ID, UserID: userID,
+		Scope: scope, Exp: time.Now().Add(refreshTokenTTL),
+	}); err != nil {
+		return nil, err
+	}
+
+	resp.RefreshToken = refresh
+	return resp, nil
+}
+
+// handleIntrospect implements RFC 7662 token introspection
+func (s *server) handleIntrospect() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			s.error(w, r, http.StatusBadRequest, errReg)
+			return
+		}
+
+		at, err := s.tokenStore.GetAccessToken(r.FormValue("token"))
+		if err != nil || time.Now().After(at.Exp) {
+			s.respond(w, r, http.StatusOK, &model.IntrospectResponse{Active: false})
+			return
+		}
+
+		s.respond(w, r, http.StatusOK, &model.IntrospectResponse{
+			Active:   true,
+			ClientID: at.ClientID,
+			UserID:   at.UserID,
+			Scope:    at.Scope,
+			Exp:      at.Exp.Unix(),
+		})
+	}
+}
+
+// handleRevoke implements RFC 7009 token revocation for both access and refresh tokens
+func (s *server) handleRevoke() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
+
+		if err := r.ParseForm(); err != nil {
+			s.error(w, r, http.StatusBadRequest, errReg)
+			return
+		}
+
+		token := r.FormValue("token")
+		if err := s.tokenStore.RevokeAccessToken(token); err != nil {
+			log.Error("access token revocation failed", "error", err)
+		}
+		if rt, err := s.tokenStore.GetRefreshToken(token); err == nil {
+			if err := s.tokenStore.RevokeFamily(rt.FamilyID); err != nil {
+				log.Error("refresh token family revocation failed", "error", err)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// requireScope returns middleware that replaces the /auth subrouter's former binary auth check:
+// a caller presenting an oauth2 bearer access token must have been granted scope, while a caller
+// authenticated via the pre-existing JWT/cookie-session flow (which predates scopes) falls back
+// to s.middleWare and is let through unchanged, since those tokens are implicitly fully trusted
+func (s *server) requireScope(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		fallback := s.middleWare(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			raw := strings.TrimPrefix(header, "Bearer ")
+			if raw == "" || raw == header {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+
+			at, err := s.tokenStore.GetAccessToken(raw)
+			if err != nil || time.Now().After(at.Exp) {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+
+			if scope != "" {
+				allowed := false
+				for _, sc := range strings.Fields(at.Scope) {
+					if sc == scope {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					s.error(w, r, http.StatusForbidden, errInvalidScope)
+					return
+				}
+			}
+
+			log := s.loggerFromContext(r.Context())
+
+			if err := s.store.User().FindUserid(at.UserID); err != nil {
+				s.error(w, r, http.StatusUnauthorized, errFindUser)
+				log.Warn("authenticated user not found", "user_id", at.UserID, "error", err)
+				return
+			}
+
+			ctx := withUserID(r.Context(), log, at.UserID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// newTrustedProxies parses CIDR blocks into the form clientIP needs; entries that fail to
+// parse are skipped rather than failing startup, since a typo here should degrade to "don't
+// trust X-Forwarded-For" rather than crash the process
+func newTrustedProxies(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// rate limit errors
+var (
+	errRateLimited     = errors.New("rate limit exceeded")
+	errTooManyAttempts = errors.New("too many login attempts")
+)
+
+const (
+	//default global per-IP limits applied to the /auth subrouter, used when newServer is
+	//given a zero-value RateLimitConfig
+	defaultAuthSubrouterRPS   = 5.0
+	defaultAuthSubrouterBurst = 10
+
+	//tighter default limit on the login endpoint itself, keyed by IP+login rather than IP alone
+	defaultAuthLoginRPS   = 1.0
+	defaultAuthLoginBurst = 5
+
+	maxLoginFailures     = 5
+	loginFailureWindow   = 15 * time.Minute
+	loginLockoutDuration = 15 * time.Minute
+)
+
+// RateLimitConfig holds the rps/burst pairs newServer wires into its rate-limited routes.
+// Zero-value fields fall back to the package defaults via withDefaults
+type RateLimitConfig struct {
+	AuthSubrouterRPS   float64
+	AuthSubrouterBurst int
+	AuthLoginRPS       float64
+	AuthLoginBurst     int
+}
+
+// withDefaults returns c with any zero-value field replaced by its package default
+func (c RateLimitConfig) withDefaults() RateLimitConfig {
+	if c.AuthSubrouterRPS == 0 {
+		c.AuthSubrouterRPS = defaultAuthSubrouterRPS
+	}
+	if c.AuthSubrouterBurst == 0 {
+		c.AuthSubrouterBurst = defaultAuthSubrouterBurst
+	}
+	if c.AuthLoginRPS == 0 {
+		c.AuthLoginRPS = defaultAuthLoginRPS
+	}
+	if c.AuthLoginBurst == 0 {
+		c.AuthLoginBurst = defaultAuthLoginBurst
+	}
+	return c
+}
+
+// RateLimiter grants or denies a request identified by key using a token bucket sized by
+// requests-per-second and a burst allowance. The default implementation is in-memory;
+// an optional Redis-backed implementation is available behind the "redis" build tag
+type RateLimiter interface {
+	Allow(key string, rps float64, burst int) bool
+}
+
+// memoryRateLimiter is the default in-memory token-bucket RateLimiter. Each distinct key
+// gets its own bucket, created lazily and kept for the life of the process
+type memoryRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{limiters: make(map[string]*rate.Limiter)}
+}
+
+func (m *memoryRateLimiter) Allow(key string, rps float64, burst int) bool {
+	m.mu.Lock()
+	limiter, ok := m.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(rps), burst)
+		m.limiters[key] = limiter
+	}
+	m.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// clientIP extracts the caller's IP, preferring the first hop of X-Forwarded-For over
+// r.RemoteAddr only when the immediate peer is one of s.trustedProxies — otherwise a caller
+// could reset their own rate-limit/lockout key just by sending a different header value
+func (s *server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && s.isTrustedProxy(host) {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return host
+}
+
+// isTrustedProxy reports whether peer is one of the configured trustedProxies
+func (s *server) isTrustedProxy(peer string) bool {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return false
+	}
+	for _, trusted := range s.trustedProxies {
+		if trusted.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipKey rate-limits purely on the caller's IP, used for the global /auth subrouter limit
+func (s *server) ipKey(r *http.Request) string {
+	return s.clientIP(r)
+}
+
+// authLoginKey rate-limits /authentication on client IP + submitted login, so a single
+// attacker can't exhaust one IP's quota across many usernames or vice versa. It peeks the
+// body to read the login field and restores it so handleAuth can still decode the request
+func (s *server) authLoginKey(r *http.Request) string {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return s.clientIP(r)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var peek struct {
+		Login string `json:"login"`
+	}
+	_ = json.Unmarshal(body, &peek)
+
+	return s.clientIP(r) + ":" + peek.Login
+}
+
+// rateLimit returns middleware enforcing rps/burst on the key extracted from each request
+func (s *server) rateLimit(key func(*http.Request) string, rps float64, burst int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.limiter.Allow(key(r), rps, burst) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(1/rps)+1))
+				s.error(w, r, http.StatusTooManyRequests, errRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -3,20 +3,26 @@ package apiserver
 import (
 	"encoding/json"
 	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/apierror"
 	"github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/model"
 	"github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/store"
 
 	"github.com/go-playground/validator"
-
-	logger "github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/logger"
 )
 
-//errors
+// problemTypeBase prefixes every problem "type" URI this service returns
+const problemTypeBase = "https://server-rest-http-ap/problems/"
+
+// errors
 var (
 	errIncorrectEmailOrPassword = errors.New("incorrect auth")
 	errReg                      = errors.New("service registration error")
@@ -25,35 +31,60 @@ var (
 	//errMssql                    = errors.New("mssql error")
 )
 
-//server configure
+// server configure
 type server struct {
-	router   *mux.Router
-	validate *validator.Validate
-	store    store.Store
-	config   *model.Service
-	client   *http.Client
+	router          *mux.Router
+	validate        *validator.Validate
+	store           store.Store
+	config          *model.Service
+	client          *http.Client
+	clientStore     store.ClientStore
+	tokenStore      store.TokenStore
+	logger          *slog.Logger
+	sessionStore    *sessions.CookieStore
+	limiter         RateLimiter
+	rateLimitConfig RateLimitConfig
+	loginAttempts   store.LoginAttemptStore
+	trustedProxies  []*net.IPNet
+	httpServer      *http.Server
 }
 
-func newServer(store store.Store, config *model.Service, client *http.Client) *server {
+// newServer wires up the server. trustedProxyCIDRs lists the proxies allowed to set
+// X-Forwarded-For (e.g. the cluster's ingress); requests from anywhere else are rate-limited
+// and locked out by r.RemoteAddr instead. limiter is the RateLimiter backing every rate-limited
+// route; pass nil to get the default in-memory implementation. rateLimitConfig's zero-value
+// fields fall back to the package defaults
+func newServer(store store.Store, config *model.Service, client *http.Client, clientStore store.ClientStore, tokenStore store.TokenStore, logger *slog.Logger, sessionStore *sessions.CookieStore, loginAttempts store.LoginAttemptStore, trustedProxyCIDRs []string, limiter RateLimiter, rateLimitConfig RateLimitConfig) *server {
+	if limiter == nil {
+		limiter = newMemoryRateLimiter()
+	}
 	s := &server{
-		router:   mux.NewRouter(),
-		validate: validator.New(),
-		store:    store,
-		config:   config,
-		client:   client,
+		router:          mux.NewRouter(),
+		validate:        validator.New(),
+		store:           store,
+		config:          config,
+		client:          client,
+		clientStore:     clientStore,
+		tokenStore:      tokenStore,
+		logger:          logger,
+		sessionStore:    sessionStore,
+		limiter:         limiter,
+		rateLimitConfig: rateLimitConfig.withDefaults(),
+		loginAttempts:   loginAttempts,
+		trustedProxies:  newTrustedProxies(trustedProxyCIDRs),
 	}
 	s.configureRouter()
 	return s
 }
 
-//custome validate date format
+// custome validate date format
 func IsDateCorrect(fl validator.FieldLevel) bool {
 	DateRegexString := "^(19|20)\\d\\d-(0[1-9]|1[012])-([012]\\d|3[01])T([01]\\d|2[0-3]):([0-5]\\d):([0-5]\\d)$"
 	DateRegex := regexp.MustCompile(DateRegexString)
 	return DateRegex.MatchString(fl.Field().String())
 }
 
-//write new token struct
+// write new token struct
 func newToken(token string, exp time.Time) *model.Token_exp {
 	return &model.Token_exp{
 		Token: token,
@@ -61,7 +92,7 @@ func newToken(token string, exp time.Time) *model.Token_exp {
 	}
 }
 
-//write response struct
+// write response struct
 func newResponse(status string, response string) *model.Response {
 	return &model.Response{
 		Status:   status,
@@ -69,13 +100,48 @@ func newResponse(status string, response string) *model.Response {
 	}
 }
 
-//write http error
+// write http error as an RFC 7807 application/problem+json response
 func (s *server) error(w http.ResponseWriter, r *http.Request, code int, err error) {
-	s.respond(w, r, code, map[string]string{"error": err.Error()})
+	problem := s.problemFor(code, err, r.URL.Path)
 
+	if holder, ok := r.Context().Value(errCtxKey{}).(*errHolder); ok {
+		holder.err = err
+	}
+
+	w.Header().Set("Content-Type", apierror.ContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
 }
 
-//write http response
+// problemFor maps a sentinel error (or a validator.ValidationErrors) to an RFC 7807 Problem,
+// falling back to a generic problem carrying err's message for anything it doesn't recognize
+func (s *server) problemFor(code int, err error, instance string) *apierror.Problem {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		return apierror.FromValidationErrors(verrs, code, instance)
+	}
+
+	switch {
+	case errors.Is(err, errIncorrectEmailOrPassword):
+		return apierror.New(problemTypeBase+"incorrect-credentials", "Incorrect email or password", code, err.Error(), instance)
+	case errors.Is(err, errJwt):
+		return apierror.New(problemTypeBase+"invalid-token", "Invalid or expired token", code, err.Error(), instance)
+	case errors.Is(err, errFindUser):
+		return apierror.New(problemTypeBase+"user-not-found", "User not found", code, err.Error(), instance)
+	case errors.Is(err, errReg):
+		return apierror.New(problemTypeBase+"decode-error", "Could not parse request body", code, err.Error(), instance)
+	case errors.Is(err, errRateLimited), errors.Is(err, errTooManyAttempts):
+		return apierror.New(problemTypeBase+"rate-limited", "Too many requests", code, err.Error(), instance)
+	case errors.Is(err, errInvalidClient), errors.Is(err, errInvalidGrant), errors.Is(err, errInvalidScope), errors.Is(err, errUnsupportedGrant), errors.Is(err, errInvalidToken):
+		return apierror.New(problemTypeBase+"oauth-error", "OAuth request rejected", code, err.Error(), instance)
+	case errors.Is(err, errCsrfToken):
+		return apierror.New(problemTypeBase+"csrf-mismatch", "CSRF token mismatch", code, err.Error(), instance)
+	default:
+		return apierror.New(problemTypeBase+"internal", http.StatusText(code), code, err.Error(), instance)
+	}
+}
+
+// write http response
 func (s *server) respond(w http.ResponseWriter, r *http.Request, code int, data interface{}) {
 	w.WriteHeader(code)
 	if data != nil {
@@ -88,90 +154,135 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) configureRouter() {
+	s.router.Use(s.requestLogging)
+	s.router.Use(s.metrics)
+	//unauthenticated operational endpoints
+	s.router.HandleFunc("/healthz", s.handleHealthz()).Methods("GET")
+	s.router.HandleFunc("/readyz", s.handleReadyz()).Methods("GET")
+	s.router.Handle("/metrics", s.handleMetrics()).Methods("GET")
 	//open
-	s.router.HandleFunc("/authentication", s.handleAuth()).Methods("POST")
+	s.router.Handle("/authentication", s.rateLimit(s.authLoginKey, s.rateLimitConfig.AuthLoginRPS, s.rateLimitConfig.AuthLoginBurst)(s.handleAuth())).Methods("POST")
+	//cookie-session login for browser clients
+	s.router.Handle("/login", s.rateLimit(s.authLoginKey, s.rateLimitConfig.AuthLoginRPS, s.rateLimitConfig.AuthLoginBurst)(s.handleLogin())).Methods("POST")
+	s.router.HandleFunc("/logout", s.handleLogout()).Methods("POST")
+	//oauth2/oidc authorization server
+	s.router.HandleFunc("/oauth/authorize", s.handleAuthorize()).Methods("GET")
+	s.router.HandleFunc("/oauth/token", s.handleToken()).Methods("POST")
+	s.router.HandleFunc("/oauth/introspect", s.handleIntrospect()).Methods("POST")
+	s.router.HandleFunc("/oauth/revoke", s.handleRevoke()).Methods("POST")
 	//private
 	auth := s.router.PathPrefix("/auth").Subrouter()
-	auth.Use(s.middleWare)
-	//booking, forms submit
-	auth.HandleFunc("/servicerequests", s.handleRequests()).Methods("POST")
-	auth.HandleFunc("/serviceorders", s.handleOrders()).Methods("POST")
-	auth.HandleFunc("/servicestatuses", s.handleStatuses()).Methods("POST")
-
+	auth.Use(s.rateLimit(s.ipKey, s.rateLimitConfig.AuthSubrouterRPS, s.rateLimitConfig.AuthSubrouterBurst))
+	auth.Use(s.csrfProtect)
+	//booking, forms submit; each route requires the matching oauth2 scope when the caller
+	//presents a bearer access token, or falls back to the existing JWT/cookie-session auth
+	auth.Handle("/servicerequests", s.requireScope(scopeServiceRequestsWrite)(s.handleRequests())).Methods("POST")
+	auth.Handle("/serviceorders", s.requireScope(scopeServiceOrdersWrite)(s.handleOrders())).Methods("POST")
+	auth.Handle("/servicestatuses", s.requireScope(scopeServiceStatusesWrite)(s.handleStatuses())).Methods("POST")
 }
 
-//handle Auth
+// handle Auth
 func (s *server) handleAuth() http.HandlerFunc {
 
 	var req model.User
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
+
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			s.error(w, r, http.StatusBadRequest, errReg)
-			logger.ErrorLogger.Println(err)
+			log.Error("decode auth request failed", "error", err)
+			return
+		}
+
+		lockoutKey := s.clientIP(r) + ":" + req.Login
+		if locked, retryAfter, err := s.loginAttempts.Locked(lockoutKey); err == nil && locked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			s.error(w, r, http.StatusTooManyRequests, errTooManyAttempts)
+			log.Warn("auth blocked by lockout", "login", req.Login)
 			return
 		}
 
 		u, err := s.store.User().FindUser(req.Login, req.Secret)
 		if err != nil {
+			if locked, retryAfter, lerr := s.loginAttempts.RecordFailure(lockoutKey, maxLoginFailures, loginFailureWindow, loginLockoutDuration); lerr == nil && locked {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			}
+			authTotal.WithLabelValues("failure").Inc()
 			s.error(w, r, http.StatusUnauthorized, errIncorrectEmailOrPassword)
-			logger.ErrorLogger.Println(err)
+			log.Warn("auth failed", "login", req.Login, "error", err)
 			return
 		}
+		authTotal.WithLabelValues("success").Inc()
+		if err := s.loginAttempts.Reset(lockoutKey); err != nil {
+			log.Error("login attempt reset failed", "error", err)
+		}
 
 		token, datetime_exp, err := s.store.User().CreateToken(uint64(u.ID), s.config)
 		if err != nil {
 			s.error(w, r, http.StatusBadRequest, errJwt)
-			logger.ErrorLogger.Println(err)
+			log.Error("token issuance failed", "user_id", u.ID, "error", err)
 			return
 		}
 		token_data := newToken(token, datetime_exp)
 		s.respond(w, r, http.StatusOK, token_data)
-		logger.InfoLogger.Println("token issued success")
+		log.Info("auth success", "user_id", u.ID)
 
 	}
 
 }
 
-//Middleware
+// Middleware accepts either a bearer JWT or a cookie session that already passed csrfProtect
 func (s *server) middleWare(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
 
-		//extract user_id
-		user_id, err := s.store.User().ExtractTokenMetadata(r, s.config)
+		userID, err := s.authenticatedUserID(r)
 		if err != nil {
 			s.error(w, r, http.StatusUnauthorized, errJwt)
-			logger.ErrorLogger.Println(err)
+			log.Warn("request authentication failed", "error", err)
 			return
 		}
 
-		if err := s.store.User().FindUserid(user_id.UserId); err != nil {
+		if err := s.store.User().FindUserid(userID); err != nil {
 			s.error(w, r, http.StatusUnauthorized, errFindUser)
-			logger.ErrorLogger.Println(err)
+			log.Warn("authenticated user not found", "user_id", userID, "error", err)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := withUserID(r.Context(), log, userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 
 	})
 
 }
 
-//handle service requests
+// authenticatedUserID extracts the caller's user id from a bearer JWT, falling back to a
+// cookie session for browser clients that went through handleLogin
+func (s *server) authenticatedUserID(r *http.Request) (uint64, error) {
+	if user_id, err := s.store.User().ExtractTokenMetadata(r, s.config); err == nil {
+		return user_id.UserId, nil
+	}
+
+	return s.sessionUserID(r)
+}
+
+// handle service requests
 func (s *server) handleRequests() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
 
 		req := model.Requests{}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
-			logger.ErrorLogger.Println(err)
+			s.error(w, r, http.StatusBadRequest, errReg)
+			log.Error("decode service request failed", "error", err)
 			return
 		}
 
 		if err := s.validate.Struct(req); err != nil {
-			logger.ErrorLogger.Println(err)
+			log.Warn("service request validation failed", "error", err)
 			s.error(w, r, http.StatusBadRequest, err)
 			return
 		}
@@ -181,30 +292,33 @@ func (s *server) handleRequests() http.HandlerFunc {
 
 }
 
-//handle service orders
+// handle service orders
 func (s *server) handleOrders() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
 
 		req := model.Orders{}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
-			logger.ErrorLogger.Println(err)
+			s.error(w, r, http.StatusBadRequest, errReg)
+			log.Error("decode order failed", "error", err)
 			return
 		}
 
 		_ = s.validate.RegisterValidation("yyyy-mm-ddThh:mm:ss", IsDateCorrect)
 
 		if err := s.validate.Struct(req); err != nil {
-			logger.ErrorLogger.Println(err)
+			log.Warn("order validation failed", "error", err)
 			s.error(w, r, http.StatusBadRequest, err)
 			return
 		}
 		s.respond(w, r, http.StatusOK, newResponse("ok", "data_received"))
 
-		if err := s.store.Data().QueryInsertOrders(req); err != nil {
-			logger.ErrorLogger.Println(err)
+		if err := observeDBQuery("QueryInsertOrders", func() error {
+			return s.store.Data().QueryInsertOrders(req)
+		}); err != nil {
+			log.Error("insert order failed", "error", err)
 			return
 		}
 
@@ -212,21 +326,22 @@ func (s *server) handleOrders() http.HandlerFunc {
 
 }
 
-//handle service statuses
+// handle service statuses
 func (s *server) handleStatuses() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.loggerFromContext(r.Context())
 
 		req := model.Statuses{}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			s.error(w, r, http.StatusBadRequest, err)
-			logger.ErrorLogger.Println(err)
+			s.error(w, r, http.StatusBadRequest, errReg)
+			log.Error("decode status failed", "error", err)
 			return
 		}
 
 		if err := s.validate.Struct(req); err != nil {
-			logger.ErrorLogger.Println(err)
+			log.Warn("status validation failed", "error", err)
 			s.error(w, r, http.StatusBadRequest, err)
 			return
 		}
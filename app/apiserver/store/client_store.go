@@ -0,0 +1,8 @@
+package store
+
+import "github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/model"
+
+// ClientStore gives access to registered OAuth2 clients
+type ClientStore interface {
+	GetByID(id string) (*model.ClientInfo, error)
+}
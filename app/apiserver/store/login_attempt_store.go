@@ -0,0 +1,15 @@
+package store
+
+import "time"
+
+// LoginAttemptStore persists consecutive authentication failures per key (typically
+// client IP + submitted login) so that brute-force lockouts survive process restarts
+type LoginAttemptStore interface {
+	//RecordFailure registers a failed attempt for key and reports whether the caller is now
+	//locked out for exceeding maxAttempts within window, plus how long the lockout lasts
+	RecordFailure(key string, maxAttempts int, window, lockout time.Duration) (locked bool, retryAfter time.Duration, err error)
+	//Reset clears the failure history for key, called after a successful login
+	Reset(key string) error
+	//Locked reports whether key is currently locked out and, if so, for how much longer
+	Locked(key string) (locked bool, retryAfter time.Duration, err error)
+}
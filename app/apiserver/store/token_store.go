@@ -0,0 +1,19 @@
+package store
+
+import "github.com/webdevolegkuprianov/server_http_rest_ar/app/apiserver/model"
+
+// TokenStore persists issued OAuth2 authorization codes, access tokens and refresh tokens
+type TokenStore interface {
+	SaveAuthCode(code *model.AuthCode) error
+	GetAuthCode(code string) (*model.AuthCode, error)
+	DeleteAuthCode(code string) error
+
+	SaveAccessToken(token *model.AccessToken) error
+	GetAccessToken(token string) (*model.AccessToken, error)
+	RevokeAccessToken(token string) error
+
+	SaveRefreshToken(token *model.RefreshToken) error
+	GetRefreshToken(token string) (*model.RefreshToken, error)
+	MarkRefreshTokenUsed(token string) error
+	RevokeFamily(familyID string) error
+}